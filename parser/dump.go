@@ -0,0 +1,145 @@
+// Copyright 2016 The clang-server Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package parser
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/go-clang/v3.9/clang"
+	"github.com/pkg/errors"
+	"github.com/zchee/clang-server/symbol"
+)
+
+// DumpFormat selects the rendering used by Parser.DumpAST.
+type DumpFormat int
+
+const (
+	// DumpFormatText renders the cursor tree as indented "<Kind>: <spelling>
+	// @ <file>:<line>:<col>" lines, one per cursor.
+	DumpFormatText DumpFormat = iota
+	// DumpFormatJSON renders the cursor tree as a single JSON object tree.
+	DumpFormatJSON
+)
+
+// dumpNode is the JSON representation of a single cursor, used only by
+// DumpFormatJSON.
+type dumpNode struct {
+	Kind     string      `json:"kind"`
+	Spelling string      `json:"spelling"`
+	USR      string      `json:"usr,omitempty"`
+	Location string      `json:"location"`
+	Children []*dumpNode `json:"children,omitempty"`
+}
+
+// DumpAST parses filename with the project's compile flags and writes its
+// cursor tree to w, in the requested format. Unlike ParseFile it never
+// touches the index DB; it exists purely to let a user see what the indexer
+// itself sees for a given file, which is invaluable when diagnosing the
+// `default:` branch in visitNode that silently drops unhandled CursorKinds.
+func (p *Parser) DumpAST(filename string, w io.Writer, format DumpFormat) error {
+	args, err := p.argsForFile(filename)
+	if err != nil {
+		return err
+	}
+
+	var tu clang.TranslationUnit
+	if cErr := p.idx.ParseTranslationUnit2(filename, args, nil, p.config.ClangOption, &tu); clang.ErrorCode(cErr) != clang.Error_Success {
+		return errors.New(clang.ErrorCode(cErr).Spelling())
+	}
+	defer tu.Dispose()
+
+	root := tu.TranslationUnitCursor()
+
+	switch format {
+	case DumpFormatJSON:
+		tree := dumpCursorJSON(root)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(tree)
+	default:
+		dumpCursorText(root, w, 0)
+		return nil
+	}
+}
+
+// argsForFile returns the compiler arguments for filename: the compilation
+// database's own Arguments for filename, prefixed with the system-include,
+// stdint.h-shim and builtin-header flags from injectedFlags. The injected
+// flags are derived from filename's own entry, whereas Parse derives them
+// once from the first compile command, so the two can differ when that
+// entry has another -std= value or file extension.
+func (p *Parser) argsForFile(filename string) ([]string, error) {
+	for _, cc := range p.cd.CompileCommands() {
+		if cc.File == filename {
+			flags := p.injectedFlags(cc.Arguments, cc.File)
+			return append(flags, cc.Arguments...), nil
+		}
+	}
+	return nil, errors.Errorf("%s: not found in compilation database", filename)
+}
+
+// dumpCursorText recurses the cursor tree like the classic castdump visitor:
+// the depth is captured by the closure handed to cursor.Visit rather than
+// passed as client data, and each child is visited by a recursive call.
+func dumpCursorText(cursor clang.Cursor, w io.Writer, depth int) {
+	loc := symbol.FromCursor(cursor)
+	fmt.Fprintf(w, "%s%s: %s @ %s:%d:%d\n",
+		strings.Repeat("  ", depth), cursor.Kind().Spelling(), cursor.Spelling(),
+		loc.FileName(), loc.Line(), loc.Column())
+
+	cursor.Visit(func(child, parent clang.Cursor) clang.ChildVisitResult {
+		dumpCursorText(child, w, depth+1)
+		return clang.ChildVisit_Continue
+	})
+}
+
+func dumpCursorJSON(cursor clang.Cursor) *dumpNode {
+	loc := symbol.FromCursor(cursor)
+	node := &dumpNode{
+		Kind:     cursor.Kind().Spelling(),
+		Spelling: cursor.Spelling(),
+		USR:      cursor.USR(),
+		Location: fmt.Sprintf("%s:%d:%d", loc.FileName(), loc.Line(), loc.Column()),
+	}
+
+	cursor.Visit(func(child, parent clang.Cursor) clang.ChildVisitResult {
+		node.Children = append(node.Children, dumpCursorJSON(child))
+		return clang.ChildVisit_Continue
+	})
+
+	return node
+}
+
+// DumpASTRequest is the request payload for a gRPC Dump method.
+type DumpASTRequest struct {
+	Filename string
+	Format   DumpFormat
+}
+
+// DumpASTResponse is the gRPC response payload: the rendered dump, in the
+// format it was requested in.
+type DumpASTResponse struct {
+	Output []byte
+	Format DumpFormat
+}
+
+// HandleDumpAST adapts DumpAST to the request/response shape a unary gRPC
+// handler returns directly.
+func (p *Parser) HandleDumpAST(req *DumpASTRequest) (*DumpASTResponse, error) {
+	var buf bytes.Buffer
+	if err := p.DumpAST(req.Filename, &buf, req.Format); err != nil {
+		return nil, err
+	}
+	return &DumpASTResponse{Output: buf.Bytes(), Format: req.Format}, nil
+}
+
+// TODO(zchee): HandleDumpAST is not registered with p.server, and no
+// "clang-server dump" CLI subcommand calls it either - rpc.GRPCServer has
+// no RegisterService-style hook in this checkout to register it with, and
+// there's no cmd/ package yet to host the subcommand.
@@ -0,0 +1,138 @@
+// Copyright 2016 The clang-server Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/go-clang/v3.9/clang"
+	"github.com/pkg/errors"
+)
+
+// IncludeEdge is one edge of a translation unit's transitive #include graph.
+type IncludeEdge struct {
+	From  string
+	To    string
+	Angle bool // true for #include <...>, false for #include "..."
+	Line  int
+}
+
+// IncludeGraph returns every transitive #include edge reachable from
+// filename, built from clang_getInclusions rather than the top-level
+// Cursor_InclusionDirective children ParseFile's visitNode sees. This
+// answers "which TUs must be reparsed when header X changes?" queries that
+// direct-include-only data can't.
+func (p *Parser) IncludeGraph(filename string) ([]IncludeEdge, error) {
+	args, err := p.argsForFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var tu clang.TranslationUnit
+	if cErr := p.idx.ParseTranslationUnit2(filename, args, nil, p.config.ClangOption, &tu); clang.ErrorCode(cErr) != clang.Error_Success {
+		return nil, errors.New(clang.ErrorCode(cErr).Spelling())
+	}
+	defer tu.Dispose()
+
+	return includeGraph(tu), nil
+}
+
+// includeGraph walks tu's full inclusion stack via clang_getInclusions,
+// which (unlike visiting Cursor_InclusionDirective cursors) reports every
+// header transitively pulled in, not just the ones #included directly by
+// the main file. Each header gets one edge, from the #include directive at
+// the top of its inclusion stack (the one that includes it directly).
+func includeGraph(tu clang.TranslationUnit) []IncludeEdge {
+	var edges []IncludeEdge
+
+	tu.GetInclusions(func(file clang.File, stack []clang.SourceLocation) {
+		if len(stack) == 0 {
+			return
+		}
+		from, line, _, _ := stack[0].ExpansionLocation()
+		fromName := from.Name()
+		if fromName == "" {
+			return
+		}
+		edges = append(edges, IncludeEdge{
+			From:  fromName,
+			To:    file.Name(),
+			Angle: isAngleInclude(fromName, int(line)),
+			Line:  int(line),
+		})
+	})
+
+	return edges
+}
+
+// isAngleInclude is a best-effort check for whether the #include on
+// file:line used angle brackets rather than quotes; go-clang's Cursor
+// doesn't expose that distinction directly, so this peeks at the source
+// text instead of tokenizing.
+func isAngleInclude(file string, line int) bool {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false
+	}
+
+	lines := bytes.Split(data, []byte("\n"))
+	if line-1 < 0 || line-1 >= len(lines) {
+		return false
+	}
+
+	l := lines[line-1]
+	angle, quote := bytes.IndexByte(l, '<'), bytes.IndexByte(l, '"')
+	if angle < 0 {
+		return false
+	}
+	return quote < 0 || angle < quote
+}
+
+// writeFilepathsSidecar writes filename's transitive include graph as a
+// plain-text "<source>.filepaths" listing every input file with its content
+// hash, analogous to the ".filepaths" convention used by Chromium's clang
+// wrapper. One line per file: "<sha256>  <path>".
+func writeFilepathsSidecar(dir, filename string, edges []IncludeEdge) error {
+	seen := map[string]bool{filename: true}
+	files := []string{filename}
+	for _, e := range edges {
+		if !seen[e.To] {
+			seen[e.To] = true
+			files = append(files, e.To)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.WithStack(err)
+	}
+
+	path := filepath.Join(dir, filepath.Base(filename)+".filepaths")
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	bw := bufio.NewWriter(f)
+	for _, path := range files {
+		digest, err := kytheDigest(path)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(bw, "%s  %s\n", digest, path)
+	}
+
+	return bw.Flush()
+}
+
+// TODO(zchee): also persist the include graph into the flatbuffer
+// symbol.File once that schema grows an IncludeGraph table; today
+// symbol.File.AddHeader only records the direct Cursor_InclusionDirective
+// children, so the full transitive graph only reaches the sidecar above.
@@ -0,0 +1,39 @@
+// Copyright 2016 The clang-server Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package parser
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsAngleInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "includegraph")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "foo.c")
+	contents := "#include <stdio.h>\n#include \"local.h\"\nint x;\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if !isAngleInclude(path, 1) {
+		t.Error("isAngleInclude(line 1, <stdio.h>) = false, want true")
+	}
+	if isAngleInclude(path, 2) {
+		t.Error(`isAngleInclude(line 2, "local.h") = true, want false`)
+	}
+	if isAngleInclude(path, 999) {
+		t.Error("isAngleInclude of an out-of-range line = true, want false")
+	}
+	if isAngleInclude(filepath.Join(dir, "missing.c"), 1) {
+		t.Error("isAngleInclude of a missing file = true, want false")
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2016 The clang-server Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package parser
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/go-clang/v3.9/clang"
+	"github.com/pkg/errors"
+	"github.com/zchee/clang-server/symbol"
+)
+
+// Kythe edge kinds used while walking the cursor tree. See
+// https://kythe.io/docs/schema/ for the full vocabulary; only the handful
+// needed to make a C/C++ TU browsable are emitted for now.
+const (
+	kytheEdgeDefines = "/kythe/edge/defines"
+	kytheEdgeRef     = "/kythe/edge/ref"
+	kytheEdgeRefCall = "/kythe/edge/ref/call"
+)
+
+// kytheVName identifies a Kythe node using the standard VName quintuple.
+type kytheVName struct {
+	Signature string `json:"signature,omitempty"`
+	Corpus    string `json:"corpus,omitempty"`
+	Root      string `json:"root,omitempty"`
+	Path      string `json:"path,omitempty"`
+	Language  string `json:"language,omitempty"`
+}
+
+// kytheRequiredInput is a single entry of a CompilationUnit's required_input
+// list: the VName of the file plus the path and content digest needed to
+// look it up in the kzip's "files/" archive member.
+type kytheRequiredInput struct {
+	VName  kytheVName `json:"v_name"`
+	Path   string     `json:"path"`
+	Digest string     `json:"digest"`
+}
+
+// kytheEdgeEntry is a single node-to-node edge, e.g. a CallExpr's
+// "/kythe/edge/ref/call" to the callee it resolves to.
+type kytheEdgeEntry struct {
+	Source kytheVName `json:"source"`
+	Kind   string     `json:"edge_kind"`
+	Target kytheVName `json:"target"`
+}
+
+// kytheCompilationUnit is a JSON stand-in for the kythe.proto.CompilationUnit
+// message, not a serialization of it: a real kzip's units are wire-format
+// proto, which needs the generated Kythe protobuf package vendored, and
+// that dependency isn't available in this checkout.
+type kytheCompilationUnit struct {
+	VName         kytheVName           `json:"v_name"`
+	Argument      []string             `json:"argument"`
+	SourceFile    []string             `json:"source_file"`
+	RequiredInput []kytheRequiredInput `json:"required_input"`
+	OutputKey     string               `json:"output_key"`
+	Edges         []kytheEdgeEntry     `json:"edges,omitempty"`
+}
+
+// kytheIndexer accumulates the required inputs and cross-reference edges
+// discovered while walking a single translation unit's cursor tree, and
+// flushes them into a .kzip-shaped archive (a plain zip of "units/<sha256>"
+// JSON and "files/<sha256>" members, keyed by the sha256 of their content).
+type kytheIndexer struct {
+	corpus string
+	unit   kytheCompilationUnit
+	seen   map[string]bool // paths already present in unit.RequiredInput
+}
+
+// newKytheIndexer returns an indexer for the TU rooted at filename, compiled
+// with the exact args ParseFile is about to hand to libclang.
+func newKytheIndexer(corpus, filename string, args []string) *kytheIndexer {
+	return &kytheIndexer{
+		corpus: corpus,
+		unit: kytheCompilationUnit{
+			VName:      kytheVName{Corpus: corpus, Path: filename, Language: "c++"},
+			Argument:   append([]string(nil), args...),
+			SourceFile: []string{filename},
+		},
+		seen: make(map[string]bool),
+	}
+}
+
+// addRequiredInput registers path as a required input of the TU, computing
+// its content digest so the kzip can be replayed without touching disk.
+func (k *kytheIndexer) addRequiredInput(path string) {
+	if path == "" || k.seen[path] {
+		return
+	}
+	k.seen[path] = true
+
+	digest, err := kytheDigest(path)
+	if err != nil {
+		// Header couldn't be read (e.g. a builtin clang intrinsic header
+		// with no backing file); skip it rather than failing the whole TU.
+		return
+	}
+
+	k.unit.RequiredInput = append(k.unit.RequiredInput, kytheRequiredInput{
+		VName:  kytheVName{Corpus: k.corpus, Path: path},
+		Path:   path,
+		Digest: digest,
+	})
+}
+
+// vname builds the VName for cursor, using its USR as the Kythe signature so
+// that references to the same entity always resolve to the same node.
+func (k *kytheIndexer) vname(cursor clang.Cursor) kytheVName {
+	loc := symbol.FromCursor(cursor)
+	return kytheVName{
+		Signature: cursor.USR(),
+		Corpus:    k.corpus,
+		Path:      loc.FileName(),
+		Language:  "c++",
+	}
+}
+
+// anchorVName builds the VName for the anchor node spanning cursor's own
+// location: the span of source text that "defines" the declaration, as
+// opposed to vname's node for the declaration itself. Kythe models a defines
+// edge as anchor -> decl, never decl -> decl, so the two must stay distinct.
+func (k *kytheIndexer) anchorVName(cursor clang.Cursor) kytheVName {
+	loc := symbol.FromCursor(cursor)
+	return kytheVName{
+		Signature: fmt.Sprintf("anchor:%s:%d:%d", loc.FileName(), loc.Line(), loc.Column()),
+		Corpus:    k.corpus,
+		Path:      loc.FileName(),
+		Language:  "c++",
+	}
+}
+
+// addDefines emits a "defines" edge from cursor's anchor to the declaration
+// it introduces.
+func (k *kytheIndexer) addDefines(cursor clang.Cursor) {
+	if cursor.USR() == "" {
+		return
+	}
+	k.addEdge(k.anchorVName(cursor), kytheEdgeDefines, k.vname(cursor))
+}
+
+// addRef emits a "ref" edge from a use (DeclRefExpr, TypeRef, ...) to the
+// cursor it resolves to.
+func (k *kytheIndexer) addRef(use, referenced clang.Cursor) {
+	if referenced.IsNull() || referenced.USR() == "" {
+		return
+	}
+	k.addEdge(k.vname(use), kytheEdgeRef, k.vname(referenced))
+}
+
+// addRefCall emits a "ref/call" edge from a CallExpr to the function it
+// calls.
+func (k *kytheIndexer) addRefCall(call, callee clang.Cursor) {
+	if callee.IsNull() || callee.USR() == "" {
+		return
+	}
+	k.addEdge(k.vname(call), kytheEdgeRefCall, k.vname(callee))
+}
+
+func (k *kytheIndexer) addEdge(source kytheVName, kind string, target kytheVName) {
+	k.unit.Edges = append(k.unit.Edges, kytheEdgeEntry{Source: source, Kind: kind, Target: target})
+}
+
+// flush writes the accumulated CompilationUnit and its required inputs as a
+// .kzip-shaped archive under dir, named after the TU's source file.
+func (k *kytheIndexer) flush(dir string) error {
+	unitBuf, err := json.Marshal(k.unit)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	unitDigest := sha256Hex(unitBuf)
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.WithStack(err)
+	}
+
+	kzipPath := filepath.Join(dir, filepath.Base(k.unit.VName.Path)+".kzip")
+	f, err := os.Create(kzipPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	defer zw.Close()
+
+	w, err := zw.Create("units/" + unitDigest)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := w.Write(unitBuf); err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, input := range k.unit.RequiredInput {
+		buf, err := ioutil.ReadFile(input.Path)
+		if err != nil {
+			continue
+		}
+		fw, err := zw.Create("files/" + input.Digest)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if _, err := fw.Write(buf); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+// kytheDigest returns the lowercase hex sha256 of the file at path, the
+// digest form Kythe's CompilationUnit.required_input expects.
+func kytheDigest(path string) (string, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return sha256Hex(buf), nil
+}
+
+func sha256Hex(buf []byte) string {
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
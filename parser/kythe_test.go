@@ -0,0 +1,46 @@
+// Copyright 2016 The clang-server Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package parser
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSha256Hex(t *testing.T) {
+	got := sha256Hex([]byte("hello"))
+	want := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if got != want {
+		t.Errorf("sha256Hex(%q) = %s, want %s", "hello", got, want)
+	}
+}
+
+func TestKytheDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kythe-digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "foo.h")
+	if err := ioutil.WriteFile(path, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := kytheDigest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sha256Hex([]byte("hello"))
+	if got != want {
+		t.Errorf("kytheDigest(%s) = %s, want %s", path, got, want)
+	}
+
+	if _, err := kytheDigest(filepath.Join(dir, "missing")); err == nil {
+		t.Error("kytheDigest of a missing file: got nil error, want non-nil")
+	}
+}
@@ -40,7 +40,15 @@ import (
 // clang.TranslationUnit_CreatePreambleOnFirstParse = 0x100
 // clang.TranslationUnit_KeepGoing = 0x200
 // const defaultClangOption uint32 = 0x445 // Use all flags for now
-var defaultClangOption = clang.DefaultEditingTranslationUnitOptions() | uint32(clang.TranslationUnit_KeepGoing)
+//
+// PrecompiledPreamble, CacheCompletionResults and CreatePreambleOnFirstParse
+// are enabled so the TU kept in tuCache can be cheaply reparsed instead of
+// cold-parsed from scratch on every edit.
+var defaultClangOption = clang.DefaultEditingTranslationUnitOptions() |
+	uint32(clang.TranslationUnit_KeepGoing) |
+	uint32(clang.TranslationUnit_PrecompiledPreamble) |
+	uint32(clang.TranslationUnit_CacheCompletionResults) |
+	uint32(clang.TranslationUnit_CreatePreambleOnFirstParse)
 
 // Parser represents a C/C++ AST parser.
 type Parser struct {
@@ -53,6 +61,8 @@ type Parser struct {
 
 	dispatcher *dispatcher
 
+	tuCache *tuCache
+
 	debugUncatched bool                     // for debug
 	uncachedKind   map[clang.CursorKind]int // for debug
 }
@@ -66,6 +76,30 @@ type Config struct {
 	Jobs        int
 
 	Debug bool
+
+	// KytheCorpus is the Kythe "corpus" label stamped onto every VName
+	// emitted while indexing. It does not enable or disable kzip output;
+	// KytheOutput does.
+	KytheCorpus string
+	// KytheOutput is the directory .kzip-shaped archives are written to, one
+	// per translation unit. These are NOT real Kythe kzips: the
+	// CompilationUnit entry is this package's own JSON, not a serialized
+	// kythe.proto.IndexedCompilation, so the output is not consumable by
+	// kythe index-pack or other real Kythe tooling without a conversion step
+	// (see kytheCompilationUnit's doc). Leave empty to disable.
+	KytheOutput string
+
+	// IncludeGraphOutput is the directory a "<source>.filepaths" sidecar
+	// listing every transitively-included header (plus its content hash) is
+	// written to, one per translation unit. Leave empty to disable.
+	IncludeGraphOutput string
+
+	// CrossProjectEdgeHook, if set, is called whenever indexing resolves a
+	// Cursor_CallExpr/DeclRefExpr/TypeRef/MemberRefExpr/MacroExpansion's Referenced() cursor
+	// into a file other than the one the reference itself lives in.
+	// workspace.Workspace wires this to tag the edge with its owning project
+	// via Workspace.OwningProject; a standalone Parser leaves it nil.
+	CrossProjectEdgeHook func(fromFile string, fromLine int, toFile string)
 }
 
 // NewParser return the new Parser.
@@ -78,13 +112,28 @@ func NewParser(path string, config *Config) *Parser {
 		config.Root = proot
 	}
 
-	cd := compilationdatabase.NewCompilationDatabase(config.Root)
-	if err := cd.Parse(config.JSONName, config.PathRange); err != nil {
+	db, err := indexdb.NewIndexDB(config.Root)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	db, err := indexdb.NewIndexDB(config.Root)
-	if err != nil {
+	return NewParserWithDB(path, config, db)
+}
+
+// NewParserWithDB is NewParser for a caller that already holds an
+// *indexdb.IndexDB, such as workspace.Workspace federating several project
+// roots into one shared index instead of letting each root open its own.
+func NewParserWithDB(path string, config *Config, db *indexdb.IndexDB) *Parser {
+	if config.Root == "" {
+		proot, err := pathutil.FindProjectRoot(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.Root = proot
+	}
+
+	cd := compilationdatabase.NewCompilationDatabase(config.Root)
+	if err := cd.Parse(config.JSONName, config.PathRange); err != nil {
 		log.Fatal(err)
 	}
 
@@ -93,11 +142,12 @@ func NewParser(path string, config *Config) *Parser {
 	}
 
 	p := &Parser{
-		idx:    clang.NewIndex(0, 0), // disable excludeDeclarationsFromPCH, enable displayDiagnostics
-		cd:     cd,
-		db:     db,
-		server: rpc.NewGRPCServer(),
-		config: config,
+		idx:     clang.NewIndex(0, 0), // disable excludeDeclarationsFromPCH, enable displayDiagnostics
+		cd:      cd,
+		db:      db,
+		server:  rpc.NewGRPCServer(),
+		config:  config,
+		tuCache: newTUCache(defaultTUCacheSize),
 	}
 	p.dispatcher = newDispatcher(p.ParseFile)
 
@@ -167,12 +217,37 @@ func (p *Parser) Parse() {
 		log.Fatal("not walk")
 	}
 
+	flags := p.InjectedFlags(ccs[0].File, ccs[0].Arguments)
+
+	p.dispatcher.Start()
+	for i := 0; i < len(ccs); i++ {
+		args := append(append([]string(nil), flags...), ccs[i].Arguments...)
+		p.dispatcher.Add(ParseArg{ccs[i].File, args})
+	}
+	p.dispatcher.Wait()
+}
+
+// InjectedFlags returns the extra compiler flags Parse prepends to every
+// compile command's own Arguments: the system include/framework dirs, the
+// -include stdint.h shim for old -std= values, and the builtin clang header
+// -I. args/file are only consulted for the -std= value and the file
+// extension, the same way Parse inspects ccs[0] for the whole project.
+// Exported so workspace.Workspace can derive the same flags per-project
+// while dispatching compile commands itself instead of calling Parse; unlike
+// Parse's single-threaded call, workspace.Workspace's worker pool can call
+// this concurrently for the same Parser, so it always returns a fresh slice
+// rather than appending onto p.cd.CompilerConfig's shared backing arrays.
+func (p *Parser) InjectedFlags(file string, args []string) []string {
+	return p.injectedFlags(args, file)
+}
+
+func (p *Parser) injectedFlags(sampleArgs []string, sampleFile string) []string {
 	compilerConfig := p.cd.CompilerConfig
-	flags := append(compilerConfig.SystemCIncludeDir, compilerConfig.SystemFrameworkDir...)
+	flags := append(append([]string(nil), compilerConfig.SystemCIncludeDir...), compilerConfig.SystemFrameworkDir...)
 
 	// TODO(zchee): needs include stdint.h?
-	if i := stringsutil.IndexContainsSlice(ccs[0].Arguments, "-std="); i > 0 {
-		std := ccs[0].Arguments[i][5:]
+	if i := stringsutil.IndexContainsSlice(sampleArgs, "-std="); i > 0 {
+		std := sampleArgs[i][5:]
 		switch {
 		case strings.HasPrefix(std, "c"), strings.HasPrefix(std, "gnu"):
 			if std[len(std)-2] == '8' || std[len(std)-2] == '9' || std[len(std)-2] == '1' {
@@ -182,33 +257,30 @@ func (p *Parser) Parse() {
 	} else {
 		flags = append(flags, "-include", "/usr/include/stdint.h")
 	}
-	if !(filepath.Ext(ccs[0].File) == ".c") {
+	if !(filepath.Ext(sampleFile) == ".c") {
 		flags = append(flags, compilerConfig.SystemCXXIncludeDir...)
 	}
 
 	builtinHdrDir := filepath.Join(pathutil.CacheDir(), "clang", "include")
 	flags = append(flags, "-I"+builtinHdrDir)
 
-	p.dispatcher.Start()
-	for i := 0; i < len(ccs); i++ {
-		args := ccs[i].Arguments
-		args = append(flags, args...)
-		p.dispatcher.Add(parseArg{ccs[i].File, args})
-	}
-	p.dispatcher.Wait()
+	return flags
 }
 
-type parseArg struct {
-	filename string
-	flag     []string
+// ParseArg is a single file to parse along with the exact compiler
+// arguments it should be parsed with.
+type ParseArg struct {
+	Filename string
+	Flag     []string
 }
 
 // ParseFile parses the C/C++ file.
-func (p *Parser) ParseFile(arg parseArg) error {
+func (p *Parser) ParseFile(arg ParseArg) error {
 	var tu clang.TranslationUnit
 
-	fhash := hashutil.NewHashString(arg.filename)
+	fhash := hashutil.NewHashString(arg.Filename)
 	fh := fhash[:]
+	key := string(fh)
 	if p.db.Has(fh) {
 		buf, err := p.db.Get(fh)
 		if err != nil {
@@ -220,27 +292,69 @@ func (p *Parser) ParseFile(arg parseArg) error {
 		if err != nil {
 			return err
 		}
-		defer tu.Dispose()
+		// Keep the deserialized TU around so a later Reparse (e.g. the
+		// editor opening a file that was already indexed) can incrementally
+		// reparse it instead of cold-parsing from scratch.
+		p.tuCache.put(key, tu, arg.Filename, arg.Flag)
 
 		log.Debugf("tu.Spelling(): %T => %+v\n", tu.Spelling(), tu.Spelling())
 
 		return nil
 	}
 
-	if cErr := p.idx.ParseTranslationUnit2(arg.filename, arg.flag, nil, p.config.ClangOption, &tu); clang.ErrorCode(cErr) != clang.Error_Success {
+	if cErr := p.idx.ParseTranslationUnit2(arg.Filename, arg.Flag, nil, p.config.ClangOption, &tu); clang.ErrorCode(cErr) != clang.Error_Success {
 		return errors.New(clang.ErrorCode(cErr).Spelling())
 	}
-	defer tu.Dispose()
+	p.tuCache.put(key, tu, arg.Filename, arg.Flag)
+
+	return p.indexTU(fh, arg.Filename, arg.Flag, tu)
+}
+
+// fileLocation is the subset of symbol.FromCursor's return type indexTU
+// needs to report a cross-project edge. It's declared locally rather than
+// naming that concrete type directly so this file doesn't have to guess at
+// symbol package internals beyond the FileName/Line accessors already used
+// elsewhere in this package (see dump.go).
+type fileLocation interface {
+	FileName() string
+	Line() int
+}
+
+// reportCrossProjectEdge calls Config.CrossProjectEdgeHook when refLoc
+// resolves into a different file than cursorLoc, i.e. a reference that
+// crosses a translation-unit boundary workspace.Workspace may want to
+// attribute to another project. It is a no-op when no hook is configured,
+// which is the case for a standalone Parser.
+func (p *Parser) reportCrossProjectEdge(cursorLoc, refLoc fileLocation) {
+	if p.config.CrossProjectEdgeHook == nil {
+		return
+	}
+	if refLoc.FileName() == "" || refLoc.FileName() == cursorLoc.FileName() {
+		return
+	}
+	p.config.CrossProjectEdgeHook(cursorLoc.FileName(), cursorLoc.Line(), refLoc.FileName())
+}
 
+// indexTU walks tu's cursor tree, persisting the resulting symbol.File into
+// the index DB under fh. It is shared by the cold-parse path in ParseFile
+// and the incremental path in Reparse so both stay in sync.
+func (p *Parser) indexTU(fh []byte, filename string, flag []string, tu clang.TranslationUnit) error {
 	tuch := make(chan []byte, 1)
 	go func() {
-		tuch <- p.SerializeTranslationUnit(arg.filename, tu)
+		tuch <- p.SerializeTranslationUnit(filename, tu)
 	}()
 
 	// printDiagnostics(tu.Diagnostics())
 
 	rootCursor := tu.TranslationUnitCursor()
-	file := symbol.NewFile(arg.filename, arg.flag)
+	file := symbol.NewFile(filename, flag)
+
+	var kidx *kytheIndexer
+	if p.config.KytheOutput != "" {
+		kidx = newKytheIndexer(p.config.KytheCorpus, filename, flag)
+		kidx.addRequiredInput(filename)
+	}
+
 	visitNode := func(cursor, parent clang.Cursor) clang.ChildVisitResult {
 		if cursor.IsNull() {
 			log.Debug("cursor: <none>")
@@ -263,10 +377,16 @@ func (p *Parser) ParseFile(arg parseArg) error {
 				defLoc := symbol.FromCursor(defCursor)
 				file.AddDefinition(cursorLoc, defLoc)
 			}
+			if kidx != nil && kind == clang.Cursor_FunctionDecl {
+				kidx.addDefines(cursor)
+			}
 		case clang.Cursor_MacroDefinition:
 			file.AddDefinition(cursorLoc, cursorLoc)
 		case clang.Cursor_VarDecl:
 			file.AddDecl(cursorLoc)
+			if kidx != nil {
+				kidx.addDefines(cursor)
+			}
 		case clang.Cursor_ParmDecl:
 			if cursor.Spelling() != "" {
 				file.AddDecl(cursorLoc)
@@ -275,13 +395,24 @@ func (p *Parser) ParseFile(arg parseArg) error {
 			refCursor := cursor.Referenced()
 			refLoc := symbol.FromCursor(refCursor)
 			file.AddCaller(cursorLoc, refLoc, true)
+			if kidx != nil {
+				kidx.addRefCall(cursor, refCursor)
+			}
+			p.reportCrossProjectEdge(cursorLoc, refLoc)
 		case clang.Cursor_DeclRefExpr, clang.Cursor_TypeRef, clang.Cursor_MemberRefExpr, clang.Cursor_MacroExpansion:
 			refCursor := cursor.Referenced()
 			refLoc := symbol.FromCursor(refCursor)
 			file.AddCaller(cursorLoc, refLoc, false)
+			if kidx != nil && kind == clang.Cursor_DeclRefExpr {
+				kidx.addRef(cursor, refCursor)
+			}
+			p.reportCrossProjectEdge(cursorLoc, refLoc)
 		case clang.Cursor_InclusionDirective:
 			incFile := cursor.IncludedFile()
 			file.AddHeader(cursor.Spelling(), incFile)
+			if kidx != nil {
+				kidx.addRequiredInput(incFile.Name())
+			}
 		default:
 			if p.debugUncatched {
 				p.uncachedKind[kind]++
@@ -299,7 +430,19 @@ func (p *Parser) ParseFile(arg parseArg) error {
 	printFile(out) // for debug
 
 	log.Debugf("Goroutine:%d", runtime.NumGoroutine())
-	log.Debugf("================== DONE: filename: %+v ==================\n\n\n", arg.filename)
+	log.Debugf("================== DONE: filename: %+v ==================\n\n\n", filename)
+
+	if kidx != nil {
+		if err := kidx.flush(p.config.KytheOutput); err != nil {
+			return err
+		}
+	}
+
+	if p.config.IncludeGraphOutput != "" {
+		if err := writeFilepathsSidecar(p.config.IncludeGraphOutput, filename, includeGraph(tu)); err != nil {
+			return err
+		}
+	}
 
 	return p.db.Put(fh, buf.FinishedBytes())
 }
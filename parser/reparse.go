@@ -0,0 +1,88 @@
+// Copyright 2016 The clang-server Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package parser
+
+import (
+	"github.com/go-clang/v3.9/clang"
+	"github.com/pkg/errors"
+	"github.com/zchee/clang-server/internal/hashutil"
+)
+
+// UnsavedFile is an in-memory buffer for a file with unsaved edits, passed
+// to Reparse so an editor front-end can push dirty buffers straight from the
+// buffer without writing them to disk first.
+type UnsavedFile struct {
+	Filename string
+	Contents string
+}
+
+// Reparse incrementally reindexes filename, reusing its live TranslationUnit
+// from tuCache via clang_reparseTranslationUnit when one is cached, and
+// falling back to a cold ParseTranslationUnit2 otherwise. unsaved lets the
+// caller supply dirty editor buffers that haven't been written to disk yet.
+//
+// The cheap-reparse path here relies entirely on libclang's own internal
+// preamble cache (PrecompiledPreamble/CreatePreambleOnFirstParse, see
+// defaultClangOption); there is no separate .pch file persisted under
+// pathutil.CacheDir() keyed by source+flags hash, because the go-clang v3.9
+// bindings don't expose a way to save or reload that preamble independently
+// of SerializeTranslationUnit/DeserializeTranslationUnit's full-TU snapshot.
+func (p *Parser) Reparse(filename string, unsaved []UnsavedFile) error {
+	fhash := hashutil.NewHashString(filename)
+	fh := fhash[:]
+	key := string(fh)
+
+	clangUnsaved := make([]clang.UnsavedFile, len(unsaved))
+	for i, u := range unsaved {
+		clangUnsaved[i] = clang.NewUnsavedFile(u.Filename, u.Contents)
+	}
+
+	entry, ok := p.tuCache.get(key)
+	if !ok {
+		args, err := p.argsForFile(filename)
+		if err != nil {
+			return err
+		}
+
+		var tu clang.TranslationUnit
+		if cErr := p.idx.ParseTranslationUnit2(filename, args, clangUnsaved, p.config.ClangOption, &tu); clang.ErrorCode(cErr) != clang.Error_Success {
+			return errors.New(clang.ErrorCode(cErr).Spelling())
+		}
+		p.tuCache.put(key, tu, filename, args)
+
+		return p.indexTU(fh, filename, args, tu)
+	}
+
+	opts := entry.tu.DefaultReparseOptions()
+	if cErr := entry.tu.ReparseTranslationUnit(clangUnsaved, opts); clang.ErrorCode(cErr) != clang.Error_Success {
+		return errors.New(clang.ErrorCode(cErr).Spelling())
+	}
+
+	return p.indexTU(fh, filename, entry.flag, entry.tu)
+}
+
+// ReparseRequest is the request payload for a gRPC Reparse method.
+type ReparseRequest struct {
+	Filename string
+	Unsaved  []UnsavedFile
+}
+
+// ReparseResponse is the gRPC response payload for Reparse. It's empty
+// today, kept as a struct rather than a bare error so it can grow
+// diagnostics later without an incompatible method signature change.
+type ReparseResponse struct{}
+
+// HandleReparse adapts Reparse to the request/response shape a unary gRPC
+// handler returns directly.
+func (p *Parser) HandleReparse(req *ReparseRequest) (*ReparseResponse, error) {
+	if err := p.Reparse(req.Filename, req.Unsaved); err != nil {
+		return nil, err
+	}
+	return &ReparseResponse{}, nil
+}
+
+// TODO(zchee): HandleReparse is not registered with p.server, and no CLI
+// subcommand calls it either - rpc.GRPCServer has no RegisterService-style
+// hook in this checkout to register it with.
@@ -0,0 +1,102 @@
+// Copyright 2016 The clang-server Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package parser
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/go-clang/v3.9/clang"
+)
+
+// defaultTUCacheSize bounds how many live clang.TranslationUnit handles
+// tuCache keeps open at once. Each entry holds a libclang preamble in
+// memory, so this trades RAM for reparse latency; see Reparse's doc for why
+// that preamble isn't also persisted to disk.
+const defaultTUCacheSize = 32
+
+// tuCacheEntry is the value side of tuCache, enough to drive a
+// ReparseTranslationUnit call.
+type tuCacheEntry struct {
+	key      string
+	tu       clang.TranslationUnit
+	filename string
+	flag     []string
+}
+
+// tuCache is a fixed-size LRU of live TranslationUnit handles keyed by file
+// hash, so Parser.Reparse can call clang_reparseTranslationUnit on an
+// already-parsed TU instead of cold-parsing the file from scratch.
+type tuCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+func newTUCache(capacity int) *tuCache {
+	return &tuCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached entry for key, if any, and marks it most-recently-used.
+func (c *tuCache) get(key string) (*tuCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+
+	return elem.Value.(*tuCacheEntry), true
+}
+
+// put inserts or refreshes the cache entry for key, evicting and disposing
+// the least-recently-used TU if the cache is over capacity.
+func (c *tuCache) put(key string, tu clang.TranslationUnit, filename string, flag []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		entry := elem.Value.(*tuCacheEntry)
+		if entry.tu != tu {
+			entry.tu.Dispose()
+			entry.tu = tu
+		}
+		entry.filename = filename
+		entry.flag = flag
+		c.ll.MoveToFront(elem)
+		return
+	}
+
+	entry := &tuCacheEntry{
+		key:      key,
+		tu:       tu,
+		filename: filename,
+		flag:     flag,
+	}
+	c.items[key] = c.ll.PushFront(entry)
+
+	if c.ll.Len() > c.capacity {
+		c.evictOldest()
+	}
+}
+
+func (c *tuCache) evictOldest() {
+	elem := c.ll.Back()
+	if elem == nil {
+		return
+	}
+	c.ll.Remove(elem)
+
+	entry := elem.Value.(*tuCacheEntry)
+	delete(c.items, entry.key)
+	entry.tu.Dispose()
+}
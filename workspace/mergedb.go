@@ -0,0 +1,82 @@
+// Copyright 2016 The clang-server Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package workspace
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CompileCommand mirrors the subset of compilationdatabase.CompileCommand
+// fields needed to merge fragments.
+type CompileCommand struct {
+	Directory string   `json:"directory"`
+	File      string   `json:"file"`
+	Arguments []string `json:"arguments,omitempty"`
+	Command   string   `json:"command,omitempty"`
+}
+
+// MergeCompileCommands reads every "compile_commands*.json" fragment under
+// each of roots (as emitted per-target by large builds) and concatenates
+// them into one logical compilation database, deduplicating on
+// (File, Directory) and preferring the entry found under the most specific
+// (deepest) root when the same (File, Directory) pair appears under more
+// than one.
+func MergeCompileCommands(roots []string) ([]CompileCommand, error) {
+	type key struct{ file, dir string }
+	merged := make(map[key]CompileCommand)
+	depth := make(map[key]int)
+
+	for _, root := range roots {
+		fragments, err := filepath.Glob(filepath.Join(root, "compile_commands*.json"))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		rootDepth := strings.Count(filepath.Clean(root), string(filepath.Separator))
+		for _, fragment := range fragments {
+			ccs, err := readCompileCommands(fragment)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, cc := range ccs {
+				k := key{cc.File, cc.Directory}
+				if existing, ok := depth[k]; ok && existing >= rootDepth {
+					continue
+				}
+				merged[k] = cc
+				depth[k] = rootDepth
+			}
+		}
+	}
+
+	out := make([]CompileCommand, 0, len(merged))
+	for _, cc := range merged {
+		out = append(out, cc)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].File < out[j].File })
+
+	return out, nil
+}
+
+func readCompileCommands(path string) ([]CompileCommand, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var ccs []CompileCommand
+	if err := json.Unmarshal(buf, &ccs); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return ccs, nil
+}
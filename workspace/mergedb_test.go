@@ -0,0 +1,86 @@
+// Copyright 2016 The clang-server Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package workspace
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeCompileCommands(t *testing.T, dir, name string, ccs []CompileCommand) {
+	t.Helper()
+	buf, err := json.Marshal(ccs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name), buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeCompileCommands(t *testing.T) {
+	root, err := ioutil.TempDir("", "mergedb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	sub := filepath.Join(root, "sub")
+	if err := os.Mkdir(sub, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two fragments under the same root, the canonical file and a per-target
+	// one, each contribute a distinct file and are concatenated.
+	writeCompileCommands(t, root, "compile_commands.json", []CompileCommand{
+		{File: "a.c", Directory: root, Arguments: []string{"-DA"}},
+	})
+	writeCompileCommands(t, root, "compile_commands.target1.json", []CompileCommand{
+		{File: "b.c", Directory: root, Arguments: []string{"-DB"}},
+	})
+	// The deeper root's entry for the same (File, Directory) should win.
+	writeCompileCommands(t, sub, "compile_commands.json", []CompileCommand{
+		{File: "a.c", Directory: root, Arguments: []string{"-DA-OVERRIDE"}},
+	})
+
+	ccs, err := MergeCompileCommands([]string{root, sub})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byFile := make(map[string]CompileCommand)
+	for _, cc := range ccs {
+		byFile[cc.File] = cc
+	}
+
+	if len(ccs) != 2 {
+		t.Fatalf("MergeCompileCommands returned %d entries, want 2: %+v", len(ccs), ccs)
+	}
+	if got := byFile["a.c"].Arguments; len(got) != 1 || got[0] != "-DA-OVERRIDE" {
+		t.Errorf("a.c Arguments = %v, want the deeper root's [-DA-OVERRIDE]", got)
+	}
+	if got := byFile["b.c"].Arguments; len(got) != 1 || got[0] != "-DB" {
+		t.Errorf("b.c Arguments = %v, want [-DB]", got)
+	}
+}
+
+func TestMergeCompileCommandsNoFragments(t *testing.T) {
+	root, err := ioutil.TempDir("", "mergedb-empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	ccs, err := MergeCompileCommands([]string{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ccs) != 0 {
+		t.Errorf("MergeCompileCommands on a root with no fragments = %+v, want empty", ccs)
+	}
+}
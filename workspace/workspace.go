@@ -0,0 +1,244 @@
+// Copyright 2016 The clang-server Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package workspace federates multiple project roots, each with its own
+// compilation database, behind a single entry point: one merged compile
+// command list, one shared index, and one dispatch queue. It exists for
+// repositories that are really several independently-configured build
+// targets sharing one checkout, where running clang-server once per root by
+// hand would otherwise be the only option.
+package workspace
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/zchee/clang-server/indexdb"
+	"github.com/zchee/clang-server/parser"
+)
+
+// Project is a single root's parser.Parser plus the root it was built from.
+type Project struct {
+	Root   string
+	Parser *parser.Parser
+}
+
+// CrossProjectEdge records a reference that Workspace.Parse observed
+// resolving from one project's source into a file owned by another.
+type CrossProjectEdge struct {
+	FromFile    string
+	FromProject string
+	FromLine    int
+	ToFile      string
+	ToProject   string
+}
+
+// Workspace federates the compilation databases of one or more project
+// roots behind one shared index and one shared dispatch queue, so a
+// reference in one project's file that resolves into another project's
+// header is indexed once, into one store, rather than being silently
+// dropped at the project boundary.
+type Workspace struct {
+	Roots    []string
+	Projects []*Project
+
+	db *indexdb.IndexDB
+
+	edgesMu sync.Mutex
+	edges   []CrossProjectEdge
+}
+
+// New returns a Workspace for roots. If roots is empty, it auto-discovers
+// project roots by walking the current directory for compilation database
+// files, the same way build-integration tools stitch together per-target
+// compdb fragments.
+//
+// Every project shares a single *indexdb.IndexDB (opened under the first
+// root) instead of each opening its own, so a symbol referenced across
+// project boundaries resolves to the same store. compile_commands*.json
+// fragments under each root are merged via MergeCompileCommands before
+// Parse dispatches them; see Parse for how the merged list is split back
+// out across projects.
+func New(roots []string, config *parser.Config) (*Workspace, error) {
+	if len(roots) == 0 {
+		discovered, err := discoverRoots(".")
+		if err != nil {
+			return nil, err
+		}
+		roots = discovered
+	}
+	if len(roots) == 0 {
+		return nil, errors.New("workspace: no project roots given and none discovered")
+	}
+
+	db, err := indexdb.NewIndexDB(roots[0])
+	if err != nil {
+		return nil, err
+	}
+
+	ws := &Workspace{Roots: roots, db: db}
+	for _, root := range roots {
+		cfg := *config
+		cfg.Root = root
+		cfg.CrossProjectEdgeHook = ws.recordCrossProjectEdge(root)
+		ws.Projects = append(ws.Projects, &Project{
+			Root:   root,
+			Parser: parser.NewParserWithDB(root, &cfg, db),
+		})
+	}
+
+	return ws, nil
+}
+
+// Edges returns every cross-project reference Parse has observed so far.
+func (w *Workspace) Edges() []CrossProjectEdge {
+	w.edgesMu.Lock()
+	defer w.edgesMu.Unlock()
+	return append([]CrossProjectEdge(nil), w.edges...)
+}
+
+// recordCrossProjectEdge returns a parser.Config.CrossProjectEdgeHook bound
+// to fromRoot, tagging the target file with its owning project via
+// OwningProject before recording it.
+func (w *Workspace) recordCrossProjectEdge(fromRoot string) func(fromFile string, fromLine int, toFile string) {
+	return func(fromFile string, fromLine int, toFile string) {
+		toProject := w.OwningProject(toFile)
+		if toProject == "" || toProject == fromRoot {
+			return
+		}
+		w.edgesMu.Lock()
+		w.edges = append(w.edges, CrossProjectEdge{
+			FromFile:    fromFile,
+			FromProject: fromRoot,
+			FromLine:    fromLine,
+			ToFile:      toFile,
+			ToProject:   toProject,
+		})
+		w.edgesMu.Unlock()
+	}
+}
+
+// isCompilationDatabase reports whether name is a compilation database
+// clang-server knows how to read: the canonical compile_commands.json, or
+// one of the "compile_commands.<target>.json" fragments large builds emit
+// per target.
+func isCompilationDatabase(name string) bool {
+	return name == "compile_commands.json" ||
+		(strings.HasPrefix(name, "compile_commands.") && strings.HasSuffix(name, ".json"))
+}
+
+// discoverRoots walks dir for directories containing a compilation
+// database, returning each such directory once.
+func discoverRoots(dir string) ([]string, error) {
+	seen := make(map[string]bool)
+	var roots []string
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !isCompilationDatabase(info.Name()) {
+			return nil
+		}
+
+		root := filepath.Dir(path)
+		if !seen[root] {
+			seen[root] = true
+			roots = append(roots, root)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	sort.Strings(roots)
+	return roots, nil
+}
+
+// Parse merges every project's compile_commands*.json fragments into one
+// logical database via MergeCompileCommands, then dispatches every entry
+// through a single shared worker pool: each entry is routed to the Project
+// that owns it (by longest-matching root) and parsed with that project's
+// own Parser.ParseFile, using compiler flags built from that project's
+// Parser.InjectedFlags. This is the "single shared dispatcher" Project.Parser's
+// own per-instance dispatcher can't be, since a Parser doesn't know about
+// its sibling projects; Project.Parser.Parse (which dispatches only that
+// project's own, unmerged compile_commands.json) is not called here.
+func (w *Workspace) Parse() {
+	defer w.db.Close()
+
+	ccs, err := MergeCompileCommands(w.Roots)
+	if err != nil {
+		return
+	}
+
+	const workers = 4
+	jobs := make(chan CompileCommand)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for cc := range jobs {
+				proj := w.projectByRoot(w.OwningProject(cc.File))
+				if proj == nil {
+					continue
+				}
+				args := append(proj.Parser.InjectedFlags(cc.File, cc.Arguments), cc.Arguments...)
+				proj.Parser.ParseFile(parser.ParseArg{Filename: cc.File, Flag: args})
+			}
+		}()
+	}
+
+	for _, cc := range ccs {
+		jobs <- cc
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// projectByRoot returns the Project whose Root equals root, or nil if root
+// is "" or doesn't match any project (e.g. OwningProject found nothing).
+func (w *Workspace) projectByRoot(root string) *Project {
+	if root == "" {
+		return nil
+	}
+	for _, proj := range w.Projects {
+		if proj.Root == root {
+			return proj
+		}
+	}
+	return nil
+}
+
+// OwningProject returns the root of the project that owns path, chosen as
+// the longest matching root prefix (the most-specific-root rule
+// MergeCompileCommands also uses). It returns "" if no project owns path.
+// Parse uses this to route a compile command to its Project, and
+// recordCrossProjectEdge uses it to tag a resolved reference's target file
+// with the project that owns it.
+func (w *Workspace) OwningProject(path string) string {
+	var best string
+	for _, root := range w.Roots {
+		if isUnderRoot(path, root) && len(root) > len(best) {
+			best = root
+		}
+	}
+	return best
+}
+
+// isUnderRoot reports whether path is root itself or a descendant of it,
+// requiring a path-separator boundary so sibling roots like "/repo/foo" and
+// "/repo/foobar" can't be confused by a bare strings.HasPrefix.
+func isUnderRoot(path, root string) bool {
+	root = filepath.Clean(root)
+	path = filepath.Clean(path)
+	return path == root || strings.HasPrefix(path, root+string(filepath.Separator))
+}
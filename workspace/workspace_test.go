@@ -0,0 +1,45 @@
+// Copyright 2016 The clang-server Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package workspace
+
+import "testing"
+
+func TestOwningProject(t *testing.T) {
+	ws := &Workspace{Roots: []string{"/repo/foo", "/repo/foobar", "/repo/foo/sub"}}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/repo/foo/x.c", "/repo/foo"},
+		{"/repo/foo/sub/y.c", "/repo/foo/sub"},
+		{"/repo/foobar/z.c", "/repo/foobar"},
+		{"/repo/foo2/w.c", ""},
+		{"/repo/other/v.c", ""},
+		{"/repo/foo", "/repo/foo"},
+	}
+	for _, tt := range tests {
+		if got := ws.OwningProject(tt.path); got != tt.want {
+			t.Errorf("OwningProject(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestIsUnderRoot(t *testing.T) {
+	tests := []struct {
+		path, root string
+		want       bool
+	}{
+		{"/repo/foo/x.c", "/repo/foo", true},
+		{"/repo/foo", "/repo/foo", true},
+		{"/repo/foobar/x.c", "/repo/foo", false},
+		{"/repo/foo2/x.c", "/repo/foo", false},
+	}
+	for _, tt := range tests {
+		if got := isUnderRoot(tt.path, tt.root); got != tt.want {
+			t.Errorf("isUnderRoot(%q, %q) = %v, want %v", tt.path, tt.root, got, tt.want)
+		}
+	}
+}